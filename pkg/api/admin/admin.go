@@ -0,0 +1,138 @@
+// Package admin exposes HTTP endpoints for inspecting and evicting async
+// workers, via NewRouter.
+//
+// NOTE: this source tree has no broker main API server (no cmd/ package, and
+// pkg/api contains nothing but this admin sub-router) for NewRouter's result
+// to be mounted onto, so that last leg of wiring isn't demonstrated here.
+// router.Use(basicAuthMiddleware(...)) inside NewRouter means the endpoints
+// are self-authenticating rather than depending on a caller that doesn't
+// exist in this snapshot to protect them.
+package admin
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/Azure/open-service-broker-azure/pkg/async/redis"
+	"github.com/gorilla/mux"
+)
+
+var errUnauthorized = errors.New("unauthorized")
+
+// PendingTaskCounts is the JSON response body for
+// GET /v2/admin/tasks/pending.
+type PendingTaskCounts struct {
+	Pending  int64 `json:"pending"`
+	Deferred int64 `json:"deferred"`
+}
+
+// WorkerInspector is the seam this package uses to inspect and evict async
+// workers. *redis.AdminInspector implements it.
+type WorkerInspector interface {
+	Workers(ctx context.Context) ([]redis.WorkerStatus, error)
+	EvictWorker(ctx context.Context, workerID string) error
+	PendingTaskCounts(ctx context.Context) (pending int64, deferred int64, err error)
+}
+
+// NewRouter returns a router exposing admin endpoints for inspecting and
+// evicting async workers:
+//
+//	GET    /v2/admin/workers         lists workers and their status
+//	DELETE /v2/admin/workers/{id}    force-evicts a worker
+//	GET    /v2/admin/tasks/pending   reports pending/deferred queue depth
+//
+// Every endpoint requires HTTP basic auth against username/password-- unlike
+// the rest of the broker's /v2 API, which is expected to be mounted behind
+// its own auth middleware upstream of this router, nothing else in this
+// source tree authenticates requests before they'd reach these handlers, so
+// this router enforces its own rather than silently relying on a caller
+// that doesn't exist here to do it.
+func NewRouter(
+	inspector WorkerInspector,
+	username string,
+	password string,
+) *mux.Router {
+	router := mux.NewRouter()
+	router.Use(basicAuthMiddleware(username, password))
+	router.HandleFunc(
+		"/v2/admin/workers",
+		getWorkers(inspector),
+	).Methods(http.MethodGet)
+	router.HandleFunc(
+		"/v2/admin/workers/{workerId}",
+		evictWorker(inspector),
+	).Methods(http.MethodDelete)
+	router.HandleFunc(
+		"/v2/admin/tasks/pending",
+		getPendingTasks(inspector),
+	).Methods(http.MethodGet)
+	return router
+}
+
+// basicAuthMiddleware rejects any request that doesn't present HTTP basic
+// auth credentials matching username/password, comparing both in constant
+// time so a timing side-channel can't be used to guess them byte by byte.
+func basicAuthMiddleware(username, password string) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			user, pass, ok := r.BasicAuth()
+			if !ok ||
+				subtle.ConstantTimeCompare([]byte(user), []byte(username)) != 1 ||
+				subtle.ConstantTimeCompare([]byte(pass), []byte(password)) != 1 {
+				w.Header().Set("WWW-Authenticate", `Basic realm="admin"`)
+				writeError(w, http.StatusUnauthorized, errUnauthorized)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+func getWorkers(inspector WorkerInspector) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		statuses, err := inspector.Workers(r.Context())
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, statuses)
+	}
+}
+
+func evictWorker(inspector WorkerInspector) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		workerID := mux.Vars(r)["workerId"]
+		if err := inspector.EvictWorker(r.Context(), workerID); err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func getPendingTasks(inspector WorkerInspector) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		pending, deferred, err := inspector.PendingTaskCounts(r.Context())
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, PendingTaskCounts{
+			Pending:  pending,
+			Deferred: deferred,
+		})
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(body)
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
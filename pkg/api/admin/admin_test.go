@@ -0,0 +1,137 @@
+package admin
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/Azure/open-service-broker-azure/pkg/async/redis"
+)
+
+const (
+	testUsername = "admin"
+	testPassword = "swordfish"
+)
+
+type fakeWorkerInspector struct {
+	workers           []redis.WorkerStatus
+	workersErr        error
+	evictWorkerID     string
+	evictErr          error
+	pending, deferred int64
+	pendingErr        error
+}
+
+func (f *fakeWorkerInspector) Workers(
+	context.Context,
+) ([]redis.WorkerStatus, error) {
+	return f.workers, f.workersErr
+}
+
+func (f *fakeWorkerInspector) EvictWorker(
+	_ context.Context,
+	workerID string,
+) error {
+	f.evictWorkerID = workerID
+	return f.evictErr
+}
+
+func (f *fakeWorkerInspector) PendingTaskCounts(
+	context.Context,
+) (int64, int64, error) {
+	return f.pending, f.deferred, f.pendingErr
+}
+
+func doRequest(
+	t *testing.T,
+	router http.Handler,
+	method, path string,
+) *httptest.ResponseRecorder {
+	t.Helper()
+	req := httptest.NewRequest(method, path, nil)
+	req.SetBasicAuth(testUsername, testPassword)
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestGetWorkersReturnsInspectorResult(t *testing.T) {
+	inspector := &fakeWorkerInspector{
+		workers: []redis.WorkerStatus{{WorkerID: "worker-1"}},
+	}
+	router := NewRouter(inspector, testUsername, testPassword)
+	rec := doRequest(t, router, http.MethodGet, "/v2/admin/workers")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", rec.Code)
+	}
+	var statuses []redis.WorkerStatus
+	if err := json.Unmarshal(rec.Body.Bytes(), &statuses); err != nil {
+		t.Fatalf("error unmarshaling response: %s", err)
+	}
+	if len(statuses) != 1 || statuses[0].WorkerID != "worker-1" {
+		t.Fatalf("unexpected response body: %s", rec.Body.String())
+	}
+}
+
+func TestGetWorkersReturns500OnInspectorError(t *testing.T) {
+	inspector := &fakeWorkerInspector{workersErr: errors.New("boom")}
+	router := NewRouter(inspector, testUsername, testPassword)
+	rec := doRequest(t, router, http.MethodGet, "/v2/admin/workers")
+	if rec.Code != http.StatusInternalServerError {
+		t.Fatalf("expected 500, got %d", rec.Code)
+	}
+}
+
+func TestEvictWorkerCallsInspectorWithPathWorkerID(t *testing.T) {
+	inspector := &fakeWorkerInspector{}
+	router := NewRouter(inspector, testUsername, testPassword)
+	rec := doRequest(t, router, http.MethodDelete, "/v2/admin/workers/worker-2")
+	if rec.Code != http.StatusNoContent {
+		t.Fatalf("expected 204, got %d", rec.Code)
+	}
+	if inspector.evictWorkerID != "worker-2" {
+		t.Fatalf(`expected evict to be called with "worker-2", got %q`, inspector.evictWorkerID)
+	}
+}
+
+func TestGetPendingTasksReturnsInspectorResult(t *testing.T) {
+	inspector := &fakeWorkerInspector{pending: 3, deferred: 2}
+	router := NewRouter(inspector, testUsername, testPassword)
+	rec := doRequest(t, router, http.MethodGet, "/v2/admin/tasks/pending")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", rec.Code)
+	}
+	var counts PendingTaskCounts
+	if err := json.Unmarshal(rec.Body.Bytes(), &counts); err != nil {
+		t.Fatalf("error unmarshaling response: %s", err)
+	}
+	if counts.Pending != 3 || counts.Deferred != 2 {
+		t.Fatalf("unexpected response body: %s", rec.Body.String())
+	}
+}
+
+func TestRouterRejectsRequestsWithoutValidBasicAuth(t *testing.T) {
+	inspector := &fakeWorkerInspector{}
+	router := NewRouter(inspector, testUsername, testPassword)
+	req := httptest.NewRequest(http.MethodGet, "/v2/admin/workers", nil)
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+	if rec.Code != http.StatusUnauthorized {
+		t.Fatalf("expected 401, got %d", rec.Code)
+	}
+}
+
+func TestRouterRejectsWrongCredentials(t *testing.T) {
+	inspector := &fakeWorkerInspector{}
+	router := NewRouter(inspector, testUsername, testPassword)
+	req := httptest.NewRequest(http.MethodGet, "/v2/admin/workers", nil)
+	req.SetBasicAuth(testUsername, "wrong-password")
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+	if rec.Code != http.StatusUnauthorized {
+		t.Fatalf("expected 401, got %d", rec.Code)
+	}
+}
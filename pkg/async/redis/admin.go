@@ -0,0 +1,197 @@
+package redis
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/go-redis/redis"
+)
+
+// WorkerStatus describes the observable state of a single async worker, as
+// surfaced by the admin HTTP endpoints.
+type WorkerStatus struct {
+	WorkerID string `json:"workerId"`
+	// HeartbeatAge is nil if the worker has no live heartbeat key-- the same
+	// condition defaultClean treats as "dead worker, clean it up"-- so a
+	// missing heartbeat is never confused with a heartbeat reported a moment
+	// ago.
+	HeartbeatAge     *time.Duration `json:"heartbeatAge"`
+	ActiveTaskCount  int64          `json:"activeTaskCount"`
+	WatchedTaskCount int64          `json:"watchedTaskCount"`
+}
+
+// workers lists the workers currently tracked in workerSetName, along with
+// how long it has been since each one last reported a heartbeat and how
+// many tasks it currently has active/watched. This surfaces the same state
+// defaultClean uses to decide a worker is dead, without waiting for the next
+// clean cycle to run.
+func (e *engine) workers(
+	ctx context.Context,
+	workerSetName string,
+) ([]WorkerStatus, error) {
+	client := e.redisClient.WithContext(ctx)
+	workerIDs, err := client.SMembers(workerSetName).Result()
+	if err != nil && err != redis.Nil {
+		return nil, fmt.Errorf("error retrieving workers: %s", err)
+	}
+	statuses := make([]WorkerStatus, 0, len(workerIDs))
+	for _, workerID := range workerIDs {
+		status := WorkerStatus{WorkerID: workerID}
+		heartbeat, err := client.Get(getHeartbeatKey(workerID)).Result()
+		if err != nil && err != redis.Nil {
+			return nil, fmt.Errorf(
+				`error reading heartbeat for worker "%s": %s`,
+				workerID,
+				err,
+			)
+		}
+		if err == nil {
+			if seconds, err := strconv.ParseInt(heartbeat, 10, 64); err == nil {
+				age := time.Since(time.Unix(seconds, 0))
+				status.HeartbeatAge = &age
+			}
+		}
+		activeCount, err := client.LLen(getActiveTaskQueueName(workerID)).Result()
+		if err != nil && err != redis.Nil {
+			return nil, fmt.Errorf(
+				`error counting active tasks for worker "%s": %s`,
+				workerID,
+				err,
+			)
+		}
+		status.ActiveTaskCount = activeCount
+		watchedCount, err :=
+			client.LLen(getWatchedTaskQueueName(workerID)).Result()
+		if err != nil && err != redis.Nil {
+			return nil, fmt.Errorf(
+				`error counting watched tasks for worker "%s": %s`,
+				workerID,
+				err,
+			)
+		}
+		status.WatchedTaskCount = watchedCount
+		statuses = append(statuses, status)
+	}
+	return statuses, nil
+}
+
+// evictWorker force-evicts workerID regardless of whether its heartbeat is
+// still current: it moves the worker's active task queue back onto
+// pendingTaskQueueName and its watched task queue back onto
+// deferredTaskQueueName-- the same paths defaultClean uses for a worker
+// that's failed its heartbeat-- and then removes it from workerSetName. This
+// gives an operator a way to recover from a wedged worker without waiting
+// for its heartbeat to expire or restarting the broker.
+func (e *engine) evictWorker(
+	ctx context.Context,
+	workerSetName string,
+	workerID string,
+	pendingTaskQueueName string,
+	deferredTaskQueueName string,
+) error {
+	if err := e.cleanActiveTaskQueue(
+		ctx,
+		workerID,
+		getActiveTaskQueueName(workerID),
+		pendingTaskQueueName,
+	); err != nil {
+		return err
+	}
+	if err := e.cleanWatchedTaskQueue(
+		ctx,
+		workerID,
+		getWatchedTaskQueueName(workerID),
+		deferredTaskQueueName,
+	); err != nil {
+		return err
+	}
+	err := e.redisClient.WithContext(ctx).SRem(workerSetName, workerID).Err()
+	if err != nil && err != redis.Nil {
+		return fmt.Errorf(
+			`error removing evicted worker "%s" from worker set: %s`,
+			workerID,
+			err,
+		)
+	}
+	return nil
+}
+
+// pendingTaskCounts returns the current depth of the pending and deferred
+// task queues.
+func (e *engine) pendingTaskCounts(
+	ctx context.Context,
+	pendingTaskQueueName string,
+	deferredTaskQueueName string,
+) (int64, int64, error) {
+	client := e.redisClient.WithContext(ctx)
+	pending, err := client.LLen(pendingTaskQueueName).Result()
+	if err != nil {
+		return 0, 0, fmt.Errorf("error counting pending tasks: %s", err)
+	}
+	deferred, err := client.LLen(deferredTaskQueueName).Result()
+	if err != nil {
+		return 0, 0, fmt.Errorf("error counting deferred tasks: %s", err)
+	}
+	return pending, deferred, nil
+}
+
+// AdminInspector adapts an *engine, together with the queue and set names it
+// was configured with, to the simple ctx-and-workerID-only signature the
+// admin HTTP API (pkg/api/admin) expects.
+type AdminInspector struct {
+	engine                *engine
+	workerSetName         string
+	pendingTaskQueueName  string
+	deferredTaskQueueName string
+}
+
+// NewAdminInspector returns an AdminInspector backed by e, reporting on and
+// evicting workers tracked under the given set/queue names.
+func NewAdminInspector(
+	e *engine,
+	workerSetName string,
+	pendingTaskQueueName string,
+	deferredTaskQueueName string,
+) *AdminInspector {
+	return &AdminInspector{
+		engine:                e,
+		workerSetName:         workerSetName,
+		pendingTaskQueueName:  pendingTaskQueueName,
+		deferredTaskQueueName: deferredTaskQueueName,
+	}
+}
+
+// Workers lists the currently tracked async workers.
+func (a *AdminInspector) Workers(
+	ctx context.Context,
+) ([]WorkerStatus, error) {
+	return a.engine.workers(ctx, a.workerSetName)
+}
+
+// EvictWorker force-evicts the worker identified by workerID.
+func (a *AdminInspector) EvictWorker(
+	ctx context.Context,
+	workerID string,
+) error {
+	return a.engine.evictWorker(
+		ctx,
+		a.workerSetName,
+		workerID,
+		a.pendingTaskQueueName,
+		a.deferredTaskQueueName,
+	)
+}
+
+// PendingTaskCounts returns the current depth of the pending and deferred
+// task queues.
+func (a *AdminInspector) PendingTaskCounts(
+	ctx context.Context,
+) (pending int64, deferred int64, err error) {
+	return a.engine.pendingTaskCounts(
+		ctx,
+		a.pendingTaskQueueName,
+		a.deferredTaskQueueName,
+	)
+}
@@ -28,7 +28,8 @@ func (e *engine) defaultClean(
 	pendingTaskQueueName string,
 	deferredTaskQueueName string,
 ) error {
-	workerIDs, err := e.redisClient.SMembers(workerSetName).Result()
+	client := e.redisClient.WithContext(ctx)
+	workerIDs, err := client.SMembers(workerSetName).Result()
 	if err == redis.Nil {
 		return nil
 	}
@@ -36,7 +37,7 @@ func (e *engine) defaultClean(
 		return fmt.Errorf("error retrieving workers: %s", err)
 	}
 	for _, workerID := range workerIDs {
-		err := e.redisClient.Get(getHeartbeatKey(workerID)).Err()
+		err := client.Get(getHeartbeatKey(workerID)).Err()
 		if err == nil {
 			select {
 			case <-ctx.Done():
@@ -69,7 +70,7 @@ func (e *engine) defaultClean(
 		); err != nil {
 			return err
 		}
-		err = e.redisClient.SRem(workerSetName, workerID).Err()
+		err = client.SRem(workerSetName, workerID).Err()
 		if err != nil && err != redis.Nil {
 			return fmt.Errorf(
 				`error removing dead worker "%s" from worker set: %s`,
@@ -93,13 +94,14 @@ func (e *engine) defaultCleanWorkerQueue(
 	sourceQueueName string,
 	destinationQueueName string,
 ) error {
+	client := e.redisClient.WithContext(ctx)
 	for {
 		select {
 		case <-ctx.Done():
 			return ctx.Err()
 		default:
 		}
-		err := e.redisClient.RPopLPush(sourceQueueName, destinationQueueName).Err()
+		err := client.RPopLPush(sourceQueueName, destinationQueueName).Err()
 		if err == redis.Nil {
 			return nil
 		}
@@ -0,0 +1,12 @@
+package crypto
+
+// Compressor is an interface to be implemented by types capable of
+// compressing payloads after they have been encoded with a Codec and before
+// they are persisted, and decompressing them after they are read back and
+// before they are decoded with a Codec.
+type Compressor interface {
+	// Compress compresses the given plaintext bytes
+	Compress(plaintext []byte) ([]byte, error)
+	// Decompress decompresses the given compressed bytes
+	Decompress(compressed []byte) ([]byte, error)
+}
@@ -0,0 +1,38 @@
+package gzip
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+
+	"github.com/Azure/open-service-broker-azure/pkg/crypto"
+)
+
+type compressor struct{}
+
+// NewCompressor returns a new gzip-based implementation of the
+// crypto.Compressor interface
+func NewCompressor() crypto.Compressor {
+	return &compressor{}
+}
+
+func (c *compressor) Compress(plaintext []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	if _, err := w.Write(plaintext); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (c *compressor) Decompress(compressed []byte) ([]byte, error) {
+	r, err := gzip.NewReader(bytes.NewReader(compressed))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close() // nolint: errcheck
+	return ioutil.ReadAll(r)
+}
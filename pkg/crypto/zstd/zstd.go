@@ -0,0 +1,32 @@
+package zstd
+
+import (
+	"github.com/Azure/open-service-broker-azure/pkg/crypto"
+	"github.com/klauspost/compress/zstd"
+)
+
+type compressor struct{}
+
+// NewCompressor returns a new zstd-based implementation of the
+// crypto.Compressor interface
+func NewCompressor() crypto.Compressor {
+	return &compressor{}
+}
+
+func (c *compressor) Compress(plaintext []byte) ([]byte, error) {
+	encoder, err := zstd.NewWriter(nil)
+	if err != nil {
+		return nil, err
+	}
+	defer encoder.Close() // nolint: errcheck
+	return encoder.EncodeAll(plaintext, nil), nil
+}
+
+func (c *compressor) Decompress(compressed []byte) ([]byte, error) {
+	decoder, err := zstd.NewReader(nil)
+	if err != nil {
+		return nil, err
+	}
+	defer decoder.Close()
+	return decoder.DecodeAll(compressed, nil)
+}
@@ -0,0 +1,72 @@
+package storage
+
+import (
+	"fmt"
+	"sync/atomic"
+)
+
+// Stored payloads carry a single magic byte identifying how they were
+// encoded. Payloads written before compression support existed have no such
+// byte-- they're raw JSON, which always starts with '{' (0x7B)-- so the
+// magic bytes below are chosen from the control-character range to keep
+// GetInstance/GetBinding backward compatible with those pre-existing keys.
+const (
+	magicByteNone       byte = 0x00
+	magicByteCompressed byte = 0x01
+)
+
+// CompressionMetrics tracks the cumulative plaintext and compressed byte
+// counts observed across all writes that were compressed, so operators can
+// see the savings compression is providing. Payloads stored uncompressed
+// because they fell below the threshold are not counted. All fields should be
+// read via atomic loads.
+type CompressionMetrics struct {
+	BytesIn  uint64
+	BytesOut uint64
+}
+
+// encodePayload prefixes plaintext with a magic byte indicating whether it
+// was compressed. When no compressor is configured (the default), plaintext
+// is returned byte-for-byte unchanged-- not even a magicByteNone prefix is
+// added-- so installs that never opt into compression keep writing plain
+// JSON, and rolling back to a pre-compression binary against the same Redis
+// still works. Payloads under the configured threshold are stored as-is
+// behind magicByteNone.
+func encodePayload(o options, plaintext []byte) ([]byte, error) {
+	if o.compressor == nil {
+		return plaintext, nil
+	}
+	if len(plaintext) < o.compressionThreshold {
+		return append([]byte{magicByteNone}, plaintext...), nil
+	}
+	compressed, err := o.compressor.Compress(plaintext)
+	if err != nil {
+		return nil, err
+	}
+	atomic.AddUint64(&o.compressionMetrics.BytesIn, uint64(len(plaintext)))
+	atomic.AddUint64(&o.compressionMetrics.BytesOut, uint64(len(compressed)))
+	return append([]byte{magicByteCompressed}, compressed...), nil
+}
+
+// decodePayload strips and interprets the magic byte written by
+// encodePayload, decompressing the remainder if necessary. Blobs that don't
+// start with a recognized magic byte predate compression support and are
+// returned unchanged.
+func decodePayload(o options, stored []byte) ([]byte, error) {
+	if len(stored) == 0 {
+		return stored, nil
+	}
+	switch stored[0] {
+	case magicByteNone:
+		return stored[1:], nil
+	case magicByteCompressed:
+		if o.compressor == nil {
+			return nil, fmt.Errorf(
+				"encountered a compressed payload but no compressor is configured",
+			)
+		}
+		return o.compressor.Decompress(stored[1:])
+	default:
+		return stored, nil
+	}
+}
@@ -0,0 +1,97 @@
+package storage
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+// upperCompressor is a trivial crypto.Compressor stand-in for tests: it
+// uppercases on "compress" and lowercases on "decompress". It exists purely
+// so encodePayload/decodePayload can be exercised without depending on the
+// gzip or zstd packages.
+type upperCompressor struct{}
+
+func (upperCompressor) Compress(plaintext []byte) ([]byte, error) {
+	return []byte(strings.ToUpper(string(plaintext))), nil
+}
+
+func (upperCompressor) Decompress(compressed []byte) ([]byte, error) {
+	return []byte(strings.ToLower(string(compressed))), nil
+}
+
+func TestEncodeDecodePayloadRoundTripsWithCompressionEnabled(t *testing.T) {
+	o := options{
+		compressor:           upperCompressor{},
+		compressionThreshold: 4,
+		compressionMetrics:   &CompressionMetrics{},
+	}
+	plaintext := []byte("a payload long enough to clear the threshold")
+	encoded, err := encodePayload(o, plaintext)
+	if err != nil {
+		t.Fatalf("encodePayload returned an error: %s", err)
+	}
+	if bytes.Equal(encoded, plaintext) {
+		t.Fatal("expected encoded payload to differ from plaintext once compressed")
+	}
+	decoded, err := decodePayload(o, encoded)
+	if err != nil {
+		t.Fatalf("decodePayload returned an error: %s", err)
+	}
+	if !bytes.Equal(decoded, plaintext) {
+		t.Fatalf("expected %q, got %q", plaintext, decoded)
+	}
+}
+
+func TestEncodeDecodePayloadBelowThresholdIsNotCompressed(t *testing.T) {
+	o := options{
+		compressor:           upperCompressor{},
+		compressionThreshold: 1024,
+		compressionMetrics:   &CompressionMetrics{},
+	}
+	plaintext := []byte("short")
+	encoded, err := encodePayload(o, plaintext)
+	if err != nil {
+		t.Fatalf("encodePayload returned an error: %s", err)
+	}
+	if encoded[0] != magicByteNone {
+		t.Fatalf("expected magicByteNone prefix, got %#x", encoded[0])
+	}
+	decoded, err := decodePayload(o, encoded)
+	if err != nil {
+		t.Fatalf("decodePayload returned an error: %s", err)
+	}
+	if !bytes.Equal(decoded, plaintext) {
+		t.Fatalf("expected %q, got %q", plaintext, decoded)
+	}
+}
+
+func TestEncodePayloadLeavesPlaintextUntouchedWithNoCompressorConfigured(t *testing.T) {
+	o := options{}
+	plaintext := []byte(`{"instanceId":"abc"}`)
+	encoded, err := encodePayload(o, plaintext)
+	if err != nil {
+		t.Fatalf("encodePayload returned an error: %s", err)
+	}
+	if !bytes.Equal(encoded, plaintext) {
+		t.Fatalf(
+			"expected encodePayload to return plaintext unchanged when no "+
+				"compressor is configured, got %q",
+			encoded,
+		)
+	}
+}
+
+func TestDecodePayloadPassesThroughLegacyUnprefixedData(t *testing.T) {
+	o := options{}
+	// Data written before compression support existed, or by an install that
+	// never configured a compressor, carries no magic byte at all.
+	legacy := []byte(`{"instanceId":"abc"}`)
+	decoded, err := decodePayload(o, legacy)
+	if err != nil {
+		t.Fatalf("decodePayload returned an error: %s", err)
+	}
+	if !bytes.Equal(decoded, legacy) {
+		t.Fatalf("expected %q, got %q", legacy, decoded)
+	}
+}
@@ -0,0 +1,17 @@
+package storage
+
+import "fmt"
+
+// ErrConflict is returned by UpdateInstance/UpdateBinding when the
+// optimistic-concurrency update loop exhausts its retries because the
+// underlying record keeps being concurrently modified by another writer.
+type ErrConflict struct {
+	Key string
+}
+
+func (e *ErrConflict) Error() string {
+	return fmt.Sprintf(
+		`concurrent modification detected for key "%s"`,
+		e.Key,
+	)
+}
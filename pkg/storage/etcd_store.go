@@ -0,0 +1,383 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+
+	"github.com/Azure/open-service-broker-azure/pkg/crypto"
+	"github.com/Azure/open-service-broker-azure/pkg/service"
+	"go.etcd.io/etcd/clientv3"
+)
+
+type etcdStore struct {
+	etcdClient *clientv3.Client
+	catalog    service.Catalog
+	codec      crypto.Codec
+	opts       options
+}
+
+// NewEtcdStore returns a new etcd3-based implementation of the Store
+// interface. Mutating operations use an optimistic-concurrency update loop
+// keyed on the record's ModRevision, so two broker replicas racing to update
+// the same instance or binding cannot silently clobber one another.
+func NewEtcdStore(
+	etcdClient *clientv3.Client,
+	catalog service.Catalog,
+	codec crypto.Codec,
+	opts ...Option,
+) Store {
+	return &etcdStore{
+		etcdClient: etcdClient,
+		catalog:    catalog,
+		codec:      codec,
+		opts:       newOptions(opts...),
+	}
+}
+
+// CompressionMetrics returns a snapshot of the bytes-in/bytes-out counters
+// tracked while compression is enabled. It returns the zero value if
+// compression was never enabled via WithCompression.
+func (e *etcdStore) CompressionMetrics() CompressionMetrics {
+	if e.opts.compressionMetrics == nil {
+		return CompressionMetrics{}
+	}
+	return CompressionMetrics{
+		BytesIn:  atomic.LoadUint64(&e.opts.compressionMetrics.BytesIn),
+		BytesOut: atomic.LoadUint64(&e.opts.compressionMetrics.BytesOut),
+	}
+}
+
+// WriteInstance unconditionally persists instance, overwriting whatever is
+// currently stored under its instance id. Because the mutator it hands to
+// UpdateInstance ignores the current value entirely, this provides no
+// conflict detection: two callers racing to WriteInstance the same instance
+// ID will simply have the later write win, silently discarding the earlier
+// one. Callers that need to detect a concurrent modification should call
+// UpdateInstance directly with a mutator that inspects the current value
+// it's given.
+func (e *etcdStore) WriteInstance(
+	ctx context.Context,
+	instance service.Instance,
+) error {
+	return e.UpdateInstance(
+		ctx,
+		instance.InstanceID,
+		func(service.Instance) (*service.Instance, error) {
+			return &instance, nil
+		},
+	)
+}
+
+func (e *etcdStore) GetInstance(
+	ctx context.Context,
+	instanceID string,
+) (service.Instance, bool, error) {
+	ctx, cancel := e.opts.withDeadline(ctx)
+	defer cancel()
+	resp, err := e.etcdClient.Get(ctx, getInstanceKey(instanceID))
+	if err != nil {
+		return service.Instance{}, false, err
+	}
+	if len(resp.Kvs) == 0 {
+		return service.Instance{}, false, nil
+	}
+	bytes, err := decodePayload(e.opts, resp.Kvs[0].Value)
+	if err != nil {
+		return service.Instance{}, false, err
+	}
+	instance, err := decodeInstance(e.catalog, bytes, e.codec)
+	return instance, err == nil, err
+}
+
+func (e *etcdStore) DeleteInstance(
+	ctx context.Context,
+	instanceID string,
+) (bool, error) {
+	ctx, cancel := e.opts.withDeadline(ctx)
+	defer cancel()
+	resp, err := e.etcdClient.Delete(ctx, getInstanceKey(instanceID))
+	if err != nil {
+		return false, err
+	}
+	return resp.Deleted > 0, nil
+}
+
+// UpdateInstance implements the optimistic-concurrency pattern: it reads the
+// current value of the key (if any) along with its ModRevision, runs mutate
+// against the decoded instance, and commits the result in a transaction that
+// only succeeds if the key's ModRevision hasn't changed since the read. If
+// the transaction is lost to a concurrent writer, it re-reads and retries,
+// up to maxUpdateRetries times. As with the Redis store, this only protects
+// a mutator that actually bases its result on the current value it's given;
+// a mutator that ignores it and always returns the same instance (as
+// WriteInstance's does) gets no conflict detection.
+func (e *etcdStore) UpdateInstance(
+	ctx context.Context,
+	instanceID string,
+	mutate InstanceMutator,
+) error {
+	ctx, cancel := e.opts.withDeadline(ctx)
+	defer cancel()
+	key := getInstanceKey(instanceID)
+	return retryOptimisticUpdate(ctx, key, func() (bool, error) {
+		return e.tryUpdateInstance(ctx, key, mutate)
+	})
+}
+
+func (e *etcdStore) tryUpdateInstance(
+	ctx context.Context,
+	key string,
+	mutate InstanceMutator,
+) (bool, error) {
+	getResp, err := e.etcdClient.Get(ctx, key)
+	if err != nil {
+		return false, err
+	}
+	var current service.Instance
+	var modRevision int64
+	if len(getResp.Kvs) > 0 {
+		modRevision = getResp.Kvs[0].ModRevision
+		bytes, err := decodePayload(e.opts, getResp.Kvs[0].Value)
+		if err != nil {
+			return false, err
+		}
+		current, err = decodeInstance(e.catalog, bytes, e.codec)
+		if err != nil {
+			return false, err
+		}
+	}
+	mutated, err := mutate(current)
+	if err != nil {
+		return false, err
+	}
+	var op clientv3.Op
+	if mutated == nil {
+		op = clientv3.OpDelete(key)
+	} else {
+		json, err := mutated.ToJSON(e.codec)
+		if err != nil {
+			return false, err
+		}
+		payload, err := encodePayload(e.opts, json)
+		if err != nil {
+			return false, err
+		}
+		op = clientv3.OpPut(key, string(payload))
+	}
+	txnResp, err := e.etcdClient.Txn(ctx).
+		If(clientv3.Compare(clientv3.ModRevision(key), "=", modRevision)).
+		Then(op).
+		Else(clientv3.OpGet(key)).
+		Commit()
+	if err != nil {
+		return false, err
+	}
+	return txnResp.Succeeded, nil
+}
+
+// WriteBinding unconditionally persists binding, the same way WriteInstance
+// does for instances-- see WriteInstance's doc comment for why that gives
+// no protection against a concurrent writer of the same binding ID.
+func (e *etcdStore) WriteBinding(
+	ctx context.Context,
+	binding service.Binding,
+) error {
+	return e.UpdateBinding(
+		ctx,
+		binding.BindingID,
+		func(service.Binding) (*service.Binding, error) {
+			return &binding, nil
+		},
+	)
+}
+
+func (e *etcdStore) GetBinding(
+	ctx context.Context,
+	bindingID string,
+) (service.Binding, bool, error) {
+	ctx, cancel := e.opts.withDeadline(ctx)
+	defer cancel()
+	resp, err := e.etcdClient.Get(ctx, getBindingKey(bindingID))
+	if err != nil {
+		return service.Binding{}, false, err
+	}
+	if len(resp.Kvs) == 0 {
+		return service.Binding{}, false, nil
+	}
+	bytes, err := decodePayload(e.opts, resp.Kvs[0].Value)
+	if err != nil {
+		return service.Binding{}, false, err
+	}
+	binding, err := decodeBinding(e.catalog, bytes, e.codec)
+	return binding, err == nil, err
+}
+
+func (e *etcdStore) DeleteBinding(
+	ctx context.Context,
+	bindingID string,
+) (bool, error) {
+	ctx, cancel := e.opts.withDeadline(ctx)
+	defer cancel()
+	resp, err := e.etcdClient.Delete(ctx, getBindingKey(bindingID))
+	if err != nil {
+		return false, err
+	}
+	return resp.Deleted > 0, nil
+}
+
+// UpdateBinding applies the same optimistic-concurrency pattern as
+// UpdateInstance to the binding persisted under bindingID, with the same
+// caveat about mutators that ignore the current value they're given.
+func (e *etcdStore) UpdateBinding(
+	ctx context.Context,
+	bindingID string,
+	mutate BindingMutator,
+) error {
+	ctx, cancel := e.opts.withDeadline(ctx)
+	defer cancel()
+	key := getBindingKey(bindingID)
+	return retryOptimisticUpdate(ctx, key, func() (bool, error) {
+		return e.tryUpdateBinding(ctx, key, mutate)
+	})
+}
+
+func (e *etcdStore) tryUpdateBinding(
+	ctx context.Context,
+	key string,
+	mutate BindingMutator,
+) (bool, error) {
+	getResp, err := e.etcdClient.Get(ctx, key)
+	if err != nil {
+		return false, err
+	}
+	var current service.Binding
+	var modRevision int64
+	if len(getResp.Kvs) > 0 {
+		modRevision = getResp.Kvs[0].ModRevision
+		bytes, err := decodePayload(e.opts, getResp.Kvs[0].Value)
+		if err != nil {
+			return false, err
+		}
+		current, err = decodeBinding(e.catalog, bytes, e.codec)
+		if err != nil {
+			return false, err
+		}
+	}
+	mutated, err := mutate(current)
+	if err != nil {
+		return false, err
+	}
+	var op clientv3.Op
+	if mutated == nil {
+		op = clientv3.OpDelete(key)
+	} else {
+		json, err := mutated.ToJSON(e.codec)
+		if err != nil {
+			return false, err
+		}
+		payload, err := encodePayload(e.opts, json)
+		if err != nil {
+			return false, err
+		}
+		op = clientv3.OpPut(key, string(payload))
+	}
+	txnResp, err := e.etcdClient.Txn(ctx).
+		If(clientv3.Compare(clientv3.ModRevision(key), "=", modRevision)).
+		Then(op).
+		Else(clientv3.OpGet(key)).
+		Commit()
+	if err != nil {
+		return false, err
+	}
+	return txnResp.Succeeded, nil
+}
+
+// ListInstances retrieves all persisted instances matching filter. Unlike
+// the Redis store, there are no maintained secondary indexes here: every
+// instance key is fetched under the instances: prefix and filter is applied
+// in memory. That's a reasonable trade-off for etcd, where a range read over
+// a prefix is already efficient and doesn't carry the blocking-KEYS concern
+// that motivates Redis's index sets.
+func (e *etcdStore) ListInstances(
+	ctx context.Context,
+	filter InstanceFilter,
+) ([]service.Instance, error) {
+	ctx, cancel := e.opts.withDeadline(ctx)
+	defer cancel()
+	resp, err := e.etcdClient.Get(
+		ctx,
+		instanceKeyPrefix,
+		clientv3.WithPrefix(),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("error listing instances: %s", err)
+	}
+	instances := make([]service.Instance, 0, len(resp.Kvs))
+	for _, kv := range resp.Kvs {
+		bytes, err := decodePayload(e.opts, kv.Value)
+		if err != nil {
+			return nil, err
+		}
+		instance, err := decodeInstance(e.catalog, bytes, e.codec)
+		if err != nil {
+			return nil, err
+		}
+		if filter.ServiceID != "" && instance.ServiceID != filter.ServiceID {
+			continue
+		}
+		if filter.PlanID != "" && instance.PlanID != filter.PlanID {
+			continue
+		}
+		instances = append(instances, instance)
+	}
+	return instances, nil
+}
+
+// ListBindingsForInstance retrieves all persisted bindings for instanceID by
+// filtering a range read over the bindings: prefix.
+func (e *etcdStore) ListBindingsForInstance(
+	ctx context.Context,
+	instanceID string,
+) ([]service.Binding, error) {
+	ctx, cancel := e.opts.withDeadline(ctx)
+	defer cancel()
+	resp, err := e.etcdClient.Get(ctx, bindingKeyPrefix, clientv3.WithPrefix())
+	if err != nil {
+		return nil, fmt.Errorf(
+			`error listing bindings for instance "%s": %s`,
+			instanceID,
+			err,
+		)
+	}
+	bindings := make([]service.Binding, 0)
+	for _, kv := range resp.Kvs {
+		bytes, err := decodePayload(e.opts, kv.Value)
+		if err != nil {
+			return nil, err
+		}
+		binding, err := decodeBinding(e.catalog, bytes, e.codec)
+		if err != nil {
+			return nil, err
+		}
+		if binding.InstanceID != instanceID {
+			continue
+		}
+		bindings = append(bindings, binding)
+	}
+	return bindings, nil
+}
+
+// ReindexAll is a no-op for the etcd store: ListInstances and
+// ListBindingsForInstance filter the primary records directly rather than
+// consulting a maintained secondary index, so there's nothing to rebuild.
+func (e *etcdStore) ReindexAll(context.Context) error {
+	return nil
+}
+
+func (e *etcdStore) TestConnection(ctx context.Context) error {
+	ctx, cancel := e.opts.withDeadline(ctx)
+	defer cancel()
+	_, err := e.etcdClient.Get(ctx, "healthcheck")
+	return err
+}
@@ -0,0 +1,530 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync/atomic"
+
+	"github.com/Azure/open-service-broker-azure/pkg/crypto"
+	"github.com/Azure/open-service-broker-azure/pkg/service"
+	"github.com/go-redis/redis"
+)
+
+type redisStore struct {
+	redisClient *redis.Client
+	catalog     service.Catalog
+	codec       crypto.Codec
+	opts        options
+}
+
+// NewRedisStore returns a new Redis-based implementation of the Store
+// interface
+func NewRedisStore(
+	redisClient *redis.Client,
+	catalog service.Catalog,
+	codec crypto.Codec,
+	opts ...Option,
+) Store {
+	return &redisStore{
+		redisClient: redisClient,
+		catalog:     catalog,
+		codec:       codec,
+		opts:        newOptions(opts...),
+	}
+}
+
+// CompressionMetrics returns a snapshot of the bytes-in/bytes-out counters
+// tracked while compression is enabled. It returns the zero value if
+// compression was never enabled via WithCompression.
+func (r *redisStore) CompressionMetrics() CompressionMetrics {
+	if r.opts.compressionMetrics == nil {
+		return CompressionMetrics{}
+	}
+	return CompressionMetrics{
+		BytesIn:  atomic.LoadUint64(&r.opts.compressionMetrics.BytesIn),
+		BytesOut: atomic.LoadUint64(&r.opts.compressionMetrics.BytesOut),
+	}
+}
+
+// WriteInstance unconditionally persists instance, overwriting whatever is
+// currently stored under its instance id. Because the mutator it hands to
+// UpdateInstance ignores the current value entirely, this provides no
+// conflict detection: two callers racing to WriteInstance the same instance
+// ID will simply have the later write win, silently discarding the earlier
+// one. Callers that need to detect a concurrent modification-- e.g. an async
+// worker finishing provisioning while a handler processes an update--
+// should call UpdateInstance directly with a mutator that inspects the
+// current value it's given.
+func (r *redisStore) WriteInstance(
+	ctx context.Context,
+	instance service.Instance,
+) error {
+	return r.UpdateInstance(
+		ctx,
+		instance.InstanceID,
+		func(service.Instance) (*service.Instance, error) {
+			return &instance, nil
+		},
+	)
+}
+
+func (r *redisStore) GetInstance(
+	ctx context.Context,
+	instanceID string,
+) (service.Instance, bool, error) {
+	ctx, cancel := r.opts.withDeadline(ctx)
+	defer cancel()
+	key := getInstanceKey(instanceID)
+	strCmd := r.redisClient.WithContext(ctx).Get(key)
+	if err := strCmd.Err(); err == redis.Nil {
+		return service.Instance{}, false, nil
+	} else if err != nil {
+		return service.Instance{}, false, err
+	}
+	stored, err := strCmd.Bytes()
+	if err != nil {
+		return service.Instance{}, false, err
+	}
+	bytes, err := decodePayload(r.opts, stored)
+	if err != nil {
+		return service.Instance{}, false, err
+	}
+	instance, err := decodeInstance(r.catalog, bytes, r.codec)
+	return instance, err == nil, err
+}
+
+func (r *redisStore) DeleteInstance(
+	ctx context.Context,
+	instanceID string,
+) (bool, error) {
+	existed := false
+	err := r.UpdateInstance(
+		ctx,
+		instanceID,
+		func(current service.Instance) (*service.Instance, error) {
+			existed = current.InstanceID != ""
+			return nil, nil
+		},
+	)
+	return existed, err
+}
+
+// UpdateInstance applies mutate to the instance persisted under instanceID
+// inside a WATCH/MULTI/EXEC transaction, so that if mutate's decision
+// depends on the current value it was given, a concurrent writer touching
+// the same key between the read and the write causes the transaction to
+// fail rather than silently clobbering the other writer's update. On a
+// failed transaction, the current value is re-read and mutate is retried,
+// up to maxUpdateRetries times. This guarantee only holds for mutators that
+// actually base their result on the current value they're passed; a
+// mutator that ignores it and always returns the same instance (as
+// WriteInstance's does) gets no conflict detection, since it would produce
+// an identical write on every retry regardless of what changed underneath
+// it.
+func (r *redisStore) UpdateInstance(
+	ctx context.Context,
+	instanceID string,
+	mutate InstanceMutator,
+) error {
+	ctx, cancel := r.opts.withDeadline(ctx)
+	defer cancel()
+	key := getInstanceKey(instanceID)
+	client := r.redisClient.WithContext(ctx)
+	return retryOptimisticUpdate(ctx, key, func() (bool, error) {
+		err := client.Watch(func(tx *redis.Tx) error {
+			var current service.Instance
+			exists := false
+			strCmd := tx.Get(key)
+			if err := strCmd.Err(); err != nil && err != redis.Nil {
+				return err
+			} else if err == nil {
+				stored, err := strCmd.Bytes()
+				if err != nil {
+					return err
+				}
+				bytes, err := decodePayload(r.opts, stored)
+				if err != nil {
+					return err
+				}
+				current, err = decodeInstance(r.catalog, bytes, r.codec)
+				if err != nil {
+					return err
+				}
+				exists = true
+			}
+			mutated, err := mutate(current)
+			if err != nil {
+				return err
+			}
+			_, err = tx.Pipelined(func(pipe redis.Pipeliner) error {
+				if mutated == nil {
+					pipe.Del(key)
+					if exists {
+						pipe.SRem(
+							getInstancesByServiceIndexKey(current.ServiceID),
+							instanceID,
+						)
+						pipe.SRem(
+							getInstancesByPlanIndexKey(current.PlanID),
+							instanceID,
+						)
+					}
+					return nil
+				}
+				// The codec is applied here, after mutate has run, so that any
+				// encrypted fields reflect the mutated plaintext rather than being
+				// re-encrypted from a stale copy.
+				json, err := mutated.ToJSON(r.codec)
+				if err != nil {
+					return err
+				}
+				payload, err := encodePayload(r.opts, json)
+				if err != nil {
+					return err
+				}
+				pipe.Set(key, payload, 0)
+				if exists && current.ServiceID != mutated.ServiceID {
+					pipe.SRem(getInstancesByServiceIndexKey(current.ServiceID), instanceID)
+				}
+				if exists && current.PlanID != mutated.PlanID {
+					pipe.SRem(getInstancesByPlanIndexKey(current.PlanID), instanceID)
+				}
+				pipe.SAdd(getInstancesByServiceIndexKey(mutated.ServiceID), instanceID)
+				pipe.SAdd(getInstancesByPlanIndexKey(mutated.PlanID), instanceID)
+				return nil
+			})
+			return err
+		}, key)
+		if err == nil {
+			return true, nil
+		}
+		if err == redis.TxFailedErr {
+			return false, nil
+		}
+		return false, err
+	})
+}
+
+// WriteBinding unconditionally persists binding, the same way WriteInstance
+// does for instances-- see WriteInstance's doc comment for why that gives
+// no protection against a concurrent writer of the same binding ID.
+func (r *redisStore) WriteBinding(
+	ctx context.Context,
+	binding service.Binding,
+) error {
+	return r.UpdateBinding(
+		ctx,
+		binding.BindingID,
+		func(service.Binding) (*service.Binding, error) {
+			return &binding, nil
+		},
+	)
+}
+
+func (r *redisStore) GetBinding(
+	ctx context.Context,
+	bindingID string,
+) (service.Binding, bool, error) {
+	ctx, cancel := r.opts.withDeadline(ctx)
+	defer cancel()
+	key := getBindingKey(bindingID)
+	strCmd := r.redisClient.WithContext(ctx).Get(key)
+	if err := strCmd.Err(); err == redis.Nil {
+		return service.Binding{}, false, nil
+	} else if err != nil {
+		return service.Binding{}, false, err
+	}
+	stored, err := strCmd.Bytes()
+	if err != nil {
+		return service.Binding{}, false, err
+	}
+	bytes, err := decodePayload(r.opts, stored)
+	if err != nil {
+		return service.Binding{}, false, err
+	}
+	binding, err := decodeBinding(r.catalog, bytes, r.codec)
+	return binding, err == nil, err
+}
+
+func (r *redisStore) DeleteBinding(
+	ctx context.Context,
+	bindingID string,
+) (bool, error) {
+	existed := false
+	err := r.UpdateBinding(
+		ctx,
+		bindingID,
+		func(current service.Binding) (*service.Binding, error) {
+			existed = current.BindingID != ""
+			return nil, nil
+		},
+	)
+	return existed, err
+}
+
+// UpdateBinding applies mutate to the binding persisted under bindingID
+// using the same WATCH/MULTI/EXEC optimistic-concurrency pattern as
+// UpdateInstance-- including the same caveat that the conflict detection
+// only protects mutators that actually consult the current value they're
+// given.
+func (r *redisStore) UpdateBinding(
+	ctx context.Context,
+	bindingID string,
+	mutate BindingMutator,
+) error {
+	ctx, cancel := r.opts.withDeadline(ctx)
+	defer cancel()
+	key := getBindingKey(bindingID)
+	client := r.redisClient.WithContext(ctx)
+	return retryOptimisticUpdate(ctx, key, func() (bool, error) {
+		err := client.Watch(func(tx *redis.Tx) error {
+			var current service.Binding
+			exists := false
+			strCmd := tx.Get(key)
+			if err := strCmd.Err(); err != nil && err != redis.Nil {
+				return err
+			} else if err == nil {
+				stored, err := strCmd.Bytes()
+				if err != nil {
+					return err
+				}
+				bytes, err := decodePayload(r.opts, stored)
+				if err != nil {
+					return err
+				}
+				current, err = decodeBinding(r.catalog, bytes, r.codec)
+				if err != nil {
+					return err
+				}
+				exists = true
+			}
+			mutated, err := mutate(current)
+			if err != nil {
+				return err
+			}
+			_, err = tx.Pipelined(func(pipe redis.Pipeliner) error {
+				if mutated == nil {
+					pipe.Del(key)
+					if exists {
+						pipe.SRem(
+							getBindingsByInstanceIndexKey(current.InstanceID),
+							bindingID,
+						)
+					}
+					return nil
+				}
+				json, err := mutated.ToJSON(r.codec)
+				if err != nil {
+					return err
+				}
+				payload, err := encodePayload(r.opts, json)
+				if err != nil {
+					return err
+				}
+				pipe.Set(key, payload, 0)
+				if exists && current.InstanceID != mutated.InstanceID {
+					pipe.SRem(
+						getBindingsByInstanceIndexKey(current.InstanceID),
+						bindingID,
+					)
+				}
+				pipe.SAdd(
+					getBindingsByInstanceIndexKey(mutated.InstanceID),
+					bindingID,
+				)
+				return nil
+			})
+			return err
+		}, key)
+		if err == nil {
+			return true, nil
+		}
+		if err == redis.TxFailedErr {
+			return false, nil
+		}
+		return false, err
+	})
+}
+
+func (r *redisStore) TestConnection(ctx context.Context) error {
+	ctx, cancel := r.opts.withDeadline(ctx)
+	defer cancel()
+	return r.redisClient.WithContext(ctx).Ping().Err()
+}
+
+// ListInstances retrieves all persisted instances matching filter. When
+// filter specifies a service and/or plan, the corresponding secondary-index
+// sets are consulted instead of scanning every instance key. An empty
+// filter falls back to a SCAN over instances:* (never KEYS, which blocks
+// the server while it walks the whole keyspace).
+func (r *redisStore) ListInstances(
+	ctx context.Context,
+	filter InstanceFilter,
+) ([]service.Instance, error) {
+	ctx, cancel := r.opts.withDeadline(ctx)
+	defer cancel()
+	client := r.redisClient.WithContext(ctx)
+	var instanceIDs []string
+	switch {
+	case filter.ServiceID != "" && filter.PlanID != "":
+		ids, err := client.SInter(
+			getInstancesByServiceIndexKey(filter.ServiceID),
+			getInstancesByPlanIndexKey(filter.PlanID),
+		).Result()
+		if err != nil && err != redis.Nil {
+			return nil, fmt.Errorf("error listing instances: %s", err)
+		}
+		instanceIDs = ids
+	case filter.ServiceID != "":
+		ids, err :=
+			client.SMembers(getInstancesByServiceIndexKey(filter.ServiceID)).Result()
+		if err != nil && err != redis.Nil {
+			return nil, fmt.Errorf("error listing instances: %s", err)
+		}
+		instanceIDs = ids
+	case filter.PlanID != "":
+		ids, err :=
+			client.SMembers(getInstancesByPlanIndexKey(filter.PlanID)).Result()
+		if err != nil && err != redis.Nil {
+			return nil, fmt.Errorf("error listing instances: %s", err)
+		}
+		instanceIDs = ids
+	default:
+		ids, err := scanKeyIDs(client, instanceKeyPrefix)
+		if err != nil {
+			return nil, fmt.Errorf("error listing instances: %s", err)
+		}
+		instanceIDs = ids
+	}
+	instances := make([]service.Instance, 0, len(instanceIDs))
+	for _, instanceID := range instanceIDs {
+		instance, ok, err := r.GetInstance(ctx, instanceID)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			// The index referenced an instance that no longer exists-- e.g. a
+			// delete raced with this read. Skip it rather than failing the list.
+			continue
+		}
+		instances = append(instances, instance)
+	}
+	return instances, nil
+}
+
+// ListBindingsForInstance retrieves all persisted bindings indexed under
+// instanceID.
+func (r *redisStore) ListBindingsForInstance(
+	ctx context.Context,
+	instanceID string,
+) ([]service.Binding, error) {
+	ctx, cancel := r.opts.withDeadline(ctx)
+	defer cancel()
+	client := r.redisClient.WithContext(ctx)
+	bindingIDs, err :=
+		client.SMembers(getBindingsByInstanceIndexKey(instanceID)).Result()
+	if err != nil && err != redis.Nil {
+		return nil, fmt.Errorf(
+			`error listing bindings for instance "%s": %s`,
+			instanceID,
+			err,
+		)
+	}
+	bindings := make([]service.Binding, 0, len(bindingIDs))
+	for _, bindingID := range bindingIDs {
+		binding, ok, err := r.GetBinding(ctx, bindingID)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			continue
+		}
+		bindings = append(bindings, binding)
+	}
+	return bindings, nil
+}
+
+// ReindexAll rebuilds the instances:by-service:*, instances:by-plan:*, and
+// bindings:by-instance:* index sets from the primary instance and binding
+// records. It scans the keyspace with SCAN rather than KEYS so it can be run
+// against a live server, and is intended for one-time use when upgrading a
+// store that predates these indexes.
+func (r *redisStore) ReindexAll(ctx context.Context) error {
+	ctx, cancel := r.opts.withDeadline(ctx)
+	defer cancel()
+	client := r.redisClient.WithContext(ctx)
+	instanceIDs, err := scanKeyIDs(client, instanceKeyPrefix)
+	if err != nil {
+		return fmt.Errorf("error scanning instance keys: %s", err)
+	}
+	for _, instanceID := range instanceIDs {
+		instance, ok, err := r.GetInstance(ctx, instanceID)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			continue
+		}
+		if err := client.SAdd(
+			getInstancesByServiceIndexKey(instance.ServiceID),
+			instanceID,
+		).Err(); err != nil {
+			return err
+		}
+		if err := client.SAdd(
+			getInstancesByPlanIndexKey(instance.PlanID),
+			instanceID,
+		).Err(); err != nil {
+			return err
+		}
+	}
+	bindingIDs, err := scanKeyIDs(client, bindingKeyPrefix)
+	if err != nil {
+		return fmt.Errorf("error scanning binding keys: %s", err)
+	}
+	for _, bindingID := range bindingIDs {
+		binding, ok, err := r.GetBinding(ctx, bindingID)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			continue
+		}
+		if err := client.SAdd(
+			getBindingsByInstanceIndexKey(binding.InstanceID),
+			bindingID,
+		).Err(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// scanKeyIDs uses SCAN to enumerate every primary (non-index) key under
+// prefix and returns the id portion of each-- i.e. the part of the key after
+// prefix-- skipping the "by-service"/"by-plan"/"by-instance" secondary-index
+// keys, which share the same prefix.
+func scanKeyIDs(client *redis.Client, prefix string) ([]string, error) {
+	var ids []string
+	var cursor uint64
+	for {
+		var keys []string
+		var err error
+		keys, cursor, err = client.Scan(cursor, prefix+"*", 100).Result()
+		if err != nil {
+			return nil, err
+		}
+		for _, key := range keys {
+			id := strings.TrimPrefix(key, prefix)
+			if strings.HasPrefix(id, "by-") {
+				continue
+			}
+			ids = append(ids, id)
+		}
+		if cursor == 0 {
+			break
+		}
+	}
+	return ids, nil
+}
@@ -0,0 +1,68 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestRetryOptimisticUpdateSucceedsImmediately(t *testing.T) {
+	calls := 0
+	err := retryOptimisticUpdate(context.Background(), "some-key", func() (bool, error) {
+		calls++
+		return true, nil
+	})
+	if err != nil {
+		t.Fatalf("expected no error, got %s", err)
+	}
+	if calls != 1 {
+		t.Fatalf("expected exactly 1 call, got %d", calls)
+	}
+}
+
+func TestRetryOptimisticUpdateSucceedsAfterConflicts(t *testing.T) {
+	calls := 0
+	err := retryOptimisticUpdate(context.Background(), "some-key", func() (bool, error) {
+		calls++
+		return calls > 3, nil
+	})
+	if err != nil {
+		t.Fatalf("expected no error, got %s", err)
+	}
+	if calls != 4 {
+		t.Fatalf("expected exactly 4 calls, got %d", calls)
+	}
+}
+
+func TestRetryOptimisticUpdateReturnsErrConflictWhenRetriesExhausted(t *testing.T) {
+	calls := 0
+	err := retryOptimisticUpdate(context.Background(), "some-key", func() (bool, error) {
+		calls++
+		return false, nil
+	})
+	if calls != maxUpdateRetries {
+		t.Fatalf("expected exactly %d calls, got %d", maxUpdateRetries, calls)
+	}
+	conflict, ok := err.(*ErrConflict)
+	if !ok {
+		t.Fatalf("expected *ErrConflict, got %T (%v)", err, err)
+	}
+	if conflict.Key != "some-key" {
+		t.Fatalf(`expected key "some-key", got %q`, conflict.Key)
+	}
+}
+
+func TestRetryOptimisticUpdatePropagatesUnretryableErrorImmediately(t *testing.T) {
+	calls := 0
+	attemptErr := errors.New("boom")
+	err := retryOptimisticUpdate(context.Background(), "some-key", func() (bool, error) {
+		calls++
+		return false, attemptErr
+	})
+	if err != attemptErr {
+		t.Fatalf("expected %s, got %s", attemptErr, err)
+	}
+	if calls != 1 {
+		t.Fatalf("expected exactly 1 call, got %d", calls)
+	}
+}
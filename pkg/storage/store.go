@@ -1,99 +1,308 @@
 package storage
 
 import (
+	"context"
 	"fmt"
+	"time"
 
 	"github.com/Azure/open-service-broker-azure/pkg/crypto"
 	"github.com/Azure/open-service-broker-azure/pkg/service"
 	"github.com/go-redis/redis"
+	"go.etcd.io/etcd/clientv3"
 )
 
+// InstanceMutator is a function that accepts the current state of an
+// instance (the zero value if no instance yet exists for the given instance
+// id) and returns the new state to be persisted, or nil to delete the
+// instance.
+type InstanceMutator func(service.Instance) (*service.Instance, error)
+
+// BindingMutator is a function that accepts the current state of a binding
+// (the zero value if no binding yet exists for the given binding id) and
+// returns the new state to be persisted, or nil to delete the binding.
+type BindingMutator func(service.Binding) (*service.Binding, error)
+
+// InstanceFilter narrows the results of ListInstances. A zero-value field is
+// not used to filter; the zero-value InstanceFilter matches every instance.
+type InstanceFilter struct {
+	ServiceID string
+	PlanID    string
+}
+
 // Store is an interface to be implemented by types capable of handling
-// persistence for other broker-related types
+// persistence for other broker-related types. Every method accepts a
+// context.Context so that a shutdown or request cancellation can interrupt a
+// blocking call to the underlying storage.
 type Store interface {
 	// WriteInstance persists the given instance to the underlying storage
-	WriteInstance(instance service.Instance) error
+	WriteInstance(ctx context.Context, instance service.Instance) error
 	// GetInstance retrieves a persisted instance from the underlying storage by
 	// instance id
-	GetInstance(instanceID string) (service.Instance, bool, error)
+	GetInstance(
+		ctx context.Context,
+		instanceID string,
+	) (service.Instance, bool, error)
 	// DeleteInstance deletes a persisted instance from the underlying storage by
 	// instance id
-	DeleteInstance(instanceID string) (bool, error)
+	DeleteInstance(ctx context.Context, instanceID string) (bool, error)
+	// UpdateInstance atomically applies the given mutator to the instance
+	// persisted under instanceID, retrying if the instance is concurrently
+	// modified by another writer. It returns ErrConflict if the retries are
+	// exhausted.
+	UpdateInstance(
+		ctx context.Context,
+		instanceID string,
+		mutate InstanceMutator,
+	) error
 	// WriteBinding persists the given binding to the underlying storage
-	WriteBinding(binding service.Binding) error
+	WriteBinding(ctx context.Context, binding service.Binding) error
 	// GetBinding retrieves a persisted instance from the underlying storage by
 	// binding id
-	GetBinding(bindingID string) (service.Binding, bool, error)
+	GetBinding(
+		ctx context.Context,
+		bindingID string,
+	) (service.Binding, bool, error)
 	// DeleteBinding deletes a persisted binding from the underlying storage by
 	// binding id
-	DeleteBinding(bindingID string) (bool, error)
+	DeleteBinding(ctx context.Context, bindingID string) (bool, error)
+	// UpdateBinding atomically applies the given mutator to the binding
+	// persisted under bindingID, retrying if the binding is concurrently
+	// modified by another writer. It returns ErrConflict if the retries are
+	// exhausted.
+	UpdateBinding(
+		ctx context.Context,
+		bindingID string,
+		mutate BindingMutator,
+	) error
 	// TestConnection tests the connection to the underlying database (if there
 	// is one)
-	TestConnection() error
+	TestConnection(ctx context.Context) error
+	// ListInstances retrieves all persisted instances matching filter. An
+	// empty filter matches every instance.
+	ListInstances(
+		ctx context.Context,
+		filter InstanceFilter,
+	) ([]service.Instance, error)
+	// ListBindingsForInstance retrieves all persisted bindings for the given
+	// instance id
+	ListBindingsForInstance(
+		ctx context.Context,
+		instanceID string,
+	) ([]service.Binding, error)
+	// ReindexAll rebuilds the secondary indexes used by ListInstances and
+	// ListBindingsForInstance from the primary instance and binding records.
+	// It is intended as a one-shot migration helper for stores that predate
+	// those indexes.
+	ReindexAll(ctx context.Context) error
 }
 
-type store struct {
-	redisClient *redis.Client
-	catalog     service.Catalog
-	codec       crypto.Codec
+// Backend identifies which concrete Store implementation NewStore should
+// construct.
+type Backend string
+
+const (
+	// BackendRedis selects NewRedisStore.
+	BackendRedis Backend = "redis"
+	// BackendEtcd selects NewEtcdStore.
+	BackendEtcd Backend = "etcd"
+)
+
+// Config collects the connection details for every backend NewStore knows
+// how to construct. Only the client field for the selected Backend needs to
+// be populated; the caller of NewStore sets Backend (see NewStore's note on
+// configuration).
+type Config struct {
+	Backend     Backend
+	RedisClient *redis.Client
+	EtcdClient  *clientv3.Client
 }
 
-// NewStore returns a new Redis-based implementation of the Store interface
+// NewStore constructs the Store implementation selected by cfg.Backend. It
+// exists so the broker can choose its storage backend from configuration
+// rather than every caller hard-coding a call to NewRedisStore or
+// NewEtcdStore directly.
+//
+// NOTE: this package has no visibility into how the broker actually reads
+// its configuration-- there is no cmd/ or config package in this source
+// tree to wire cfg.Backend up to an environment variable or config file
+// key. NewStore is the selection point that bootstrap code is expected to
+// call once it exists; until then, constructing a Config and calling
+// NewStore is still the caller's responsibility.
 func NewStore(
-	redisClient *redis.Client,
+	cfg Config,
 	catalog service.Catalog,
 	codec crypto.Codec,
-) Store {
-	return &store{
-		redisClient: redisClient,
-		catalog:     catalog,
-		codec:       codec,
+	opts ...Option,
+) (Store, error) {
+	switch cfg.Backend {
+	case BackendRedis:
+		if cfg.RedisClient == nil {
+			return nil, fmt.Errorf(
+				"redis storage backend selected but no redis client was provided",
+			)
+		}
+		return NewRedisStore(cfg.RedisClient, catalog, codec, opts...), nil
+	case BackendEtcd:
+		if cfg.EtcdClient == nil {
+			return nil, fmt.Errorf(
+				"etcd storage backend selected but no etcd client was provided",
+			)
+		}
+		return NewEtcdStore(cfg.EtcdClient, catalog, codec, opts...), nil
+	default:
+		return nil, fmt.Errorf(`unrecognized storage backend "%s"`, cfg.Backend)
 	}
 }
 
-func (s *store) WriteInstance(instance service.Instance) error {
-	key := getInstanceKey(instance.InstanceID)
-	json, err := instance.ToJSON(s.codec)
-	if err != nil {
-		return err
+// maxUpdateRetries bounds the number of times an optimistic-concurrency
+// update loop will retry before giving up and returning ErrConflict.
+const maxUpdateRetries = 10
+
+// retryOptimisticUpdate calls attempt up to maxUpdateRetries times, stopping
+// as soon as one call reports success, and returns ErrConflict for key if
+// every attempt is lost to a concurrent writer. It factors out the retry
+// loop shared by the Redis and etcd stores' UpdateInstance/UpdateBinding
+// methods so that loop can be unit-tested without a live Redis or etcd
+// server. attempt is responsible for translating its backend's own
+// lost-transaction signal (a failed WATCH, a failed etcd Txn, ...) into
+// (false, nil); any other non-nil error is treated as unretryable and
+// returned immediately.
+func retryOptimisticUpdate(
+	ctx context.Context,
+	key string,
+	attempt func() (bool, error),
+) error {
+	for i := 0; i < maxUpdateRetries; i++ {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		default:
+		}
+		succeeded, err := attempt()
+		if err != nil {
+			return err
+		}
+		if succeeded {
+			return nil
+		}
 	}
-	return s.redisClient.Set(key, json, 0).Err()
+	return &ErrConflict{Key: key}
 }
 
-func (s *store) GetInstance(instanceID string) (service.Instance, bool, error) {
-	key := getInstanceKey(instanceID)
-	strCmd := s.redisClient.Get(key)
-	if err := strCmd.Err(); err == redis.Nil {
-		return service.Instance{}, false, nil
-	} else if err != nil {
-		return service.Instance{}, false, err
+// Option configures optional behavior shared by the Store implementations.
+type Option func(*options)
+
+type options struct {
+	timeout time.Duration
+
+	compressor           crypto.Compressor
+	compressionThreshold int
+	compressionMetrics   *CompressionMetrics
+}
+
+// WithTimeout sets a default per-call timeout applied to any Store method
+// invoked with a context.Context that doesn't already carry a deadline. This
+// lets the broker API path bound how long a single storage call can block
+// without requiring every caller to build its own timeout context.
+func WithTimeout(timeout time.Duration) Option {
+	return func(o *options) {
+		o.timeout = timeout
 	}
-	bytes, err := strCmd.Bytes()
-	if err != nil {
-		return service.Instance{}, false, err
+}
+
+// WithCompression enables transparent compression of stored instance and
+// binding payloads using the given compressor. Payloads smaller than
+// thresholdBytes are left uncompressed, since compression overhead isn't
+// worth paying for small values. Compression is off by default.
+func WithCompression(
+	compressor crypto.Compressor,
+	thresholdBytes int,
+) Option {
+	return func(o *options) {
+		o.compressor = compressor
+		o.compressionThreshold = thresholdBytes
+		o.compressionMetrics = &CompressionMetrics{}
 	}
-	instance, err := service.NewInstanceFromJSON(bytes, nil, nil, nil, s.codec)
+}
+
+func newOptions(opts ...Option) options {
+	var o options
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o
+}
+
+// withDeadline returns ctx unchanged if it already has a deadline or no
+// default timeout was configured; otherwise it derives a ctx bounded by the
+// configured default timeout. The returned cancel func is always safe to
+// call.
+func (o options) withDeadline(
+	ctx context.Context,
+) (context.Context, context.CancelFunc) {
+	if o.timeout <= 0 {
+		return ctx, func() {}
+	}
+	if _, ok := ctx.Deadline(); ok {
+		return ctx, func() {}
+	}
+	return context.WithTimeout(ctx, o.timeout)
+}
+
+func getInstanceKey(instanceID string) string {
+	return fmt.Sprintf("instances:%s", instanceID)
+}
+
+func getBindingKey(bindingID string) string {
+	return fmt.Sprintf("bindings:%s", bindingID)
+}
+
+// instanceKeyPrefix/bindingKeyPrefix are the prefixes under which primary
+// instance/binding records-- as opposed to secondary-index entries-- are
+// stored, so a SCAN over all keys can tell the two apart.
+const (
+	instanceKeyPrefix = "instances:"
+	bindingKeyPrefix  = "bindings:"
+)
+
+func getInstancesByServiceIndexKey(serviceID string) string {
+	return fmt.Sprintf("instances:by-service:%s", serviceID)
+}
+
+func getInstancesByPlanIndexKey(planID string) string {
+	return fmt.Sprintf("instances:by-plan:%s", planID)
+}
+
+func getBindingsByInstanceIndexKey(instanceID string) string {
+	return fmt.Sprintf("bindings:by-instance:%s", instanceID)
+}
+
+// decodeInstance decodes the given raw bytes into a service.Instance,
+// consulting the catalog to find the provisioning/updating parameters and
+// instance details types appropriate to the instance's service and plan.
+func decodeInstance(
+	catalog service.Catalog,
+	bytes []byte,
+	codec crypto.Codec,
+) (service.Instance, error) {
+	instance, err := service.NewInstanceFromJSON(bytes, nil, nil, nil, codec)
 	if err != nil {
-		return instance, false, err
+		return instance, err
 	}
-	svc, ok := s.catalog.GetService(instance.ServiceID)
+	svc, ok := catalog.GetService(instance.ServiceID)
 	if !ok {
-		return instance,
-			false,
-			fmt.Errorf(
-				`service not found in catalog for service ID "%s"`,
-				instance.ServiceID,
-			)
+		return instance, fmt.Errorf(
+			`service not found in catalog for service ID "%s"`,
+			instance.ServiceID,
+		)
 	}
 	plan, ok := svc.GetPlan(instance.PlanID)
 	if !ok {
-		return instance,
-			false,
-			fmt.Errorf(
-				`plan not found for planID "%s" for service "%s" in the catalog`,
-				instance.PlanID,
-				instance.ServiceID,
-			)
+		return instance, fmt.Errorf(
+			`plan not found for planID "%s" for service "%s" in the catalog`,
+			instance.PlanID,
+			instance.ServiceID,
+		)
 	}
 	serviceManager := svc.GetServiceManager()
 	instance, err = service.NewInstanceFromJSON(
@@ -101,93 +310,38 @@ func (s *store) GetInstance(instanceID string) (service.Instance, bool, error) {
 		serviceManager.GetEmptyProvisioningParameters(),
 		serviceManager.GetEmptyUpdatingParameters(),
 		serviceManager.GetEmptyInstanceDetails(),
-		s.codec,
+		codec,
 	)
 	instance.Service = svc
 	instance.Plan = plan
-	return instance, err == nil, err
-}
-
-func (s *store) DeleteInstance(instanceID string) (bool, error) {
-	key := getInstanceKey(instanceID)
-	strCmd := s.redisClient.Get(key)
-	if err := strCmd.Err(); err == redis.Nil {
-		return false, nil
-	} else if err != nil {
-		return false, err
-	}
-	if err := s.redisClient.Del(key).Err(); err != nil {
-		return false, err
-	}
-	return true, nil
-}
-
-func getInstanceKey(instanceID string) string {
-	return fmt.Sprintf("instances:%s", instanceID)
-}
-
-func (s *store) WriteBinding(binding service.Binding) error {
-	key := getBindingKey(binding.BindingID)
-	json, err := binding.ToJSON(s.codec)
-	if err != nil {
-		return err
-	}
-	return s.redisClient.Set(key, json, 0).Err()
+	return instance, err
 }
 
-func (s *store) GetBinding(bindingID string) (service.Binding, bool, error) {
-	key := getBindingKey(bindingID)
-	strCmd := s.redisClient.Get(key)
-	if err := strCmd.Err(); err == redis.Nil {
-		return service.Binding{}, false, nil
-	} else if err != nil {
-		return service.Binding{}, false, err
-	}
-	bytes, err := strCmd.Bytes()
-	if err != nil {
-		return service.Binding{}, false, err
-	}
-	binding, err := service.NewBindingFromJSON(bytes, nil, nil, s.codec)
+// decodeBinding decodes the given raw bytes into a service.Binding,
+// consulting the catalog to find the binding parameters and binding details
+// types appropriate to the binding's service.
+func decodeBinding(
+	catalog service.Catalog,
+	bytes []byte,
+	codec crypto.Codec,
+) (service.Binding, error) {
+	binding, err := service.NewBindingFromJSON(bytes, nil, nil, codec)
 	if err != nil {
-		return binding, false, err
+		return binding, err
 	}
-	svc, ok := s.catalog.GetService(binding.ServiceID)
+	svc, ok := catalog.GetService(binding.ServiceID)
 	if !ok {
-		return binding,
-			false,
-			fmt.Errorf(
-				`service not found in catalog for service ID "%s"`,
-				binding.ServiceID,
-			)
+		return binding, fmt.Errorf(
+			`service not found in catalog for service ID "%s"`,
+			binding.ServiceID,
+		)
 	}
 	serviceManager := svc.GetServiceManager()
 	binding, err = service.NewBindingFromJSON(
 		bytes,
 		serviceManager.GetEmptyBindingParameters(),
 		serviceManager.GetEmptyBindingDetails(),
-		s.codec,
+		codec,
 	)
-	return binding, err == nil, err
-}
-
-func (s *store) DeleteBinding(bindingID string) (bool, error) {
-	key := getBindingKey(bindingID)
-	strCmd := s.redisClient.Get(key)
-	if err := strCmd.Err(); err == redis.Nil {
-		return false, nil
-	} else if err != nil {
-		return false, err
-	}
-	if err := s.redisClient.Del(key).Err(); err != nil {
-		return false, err
-	}
-	return true, nil
-}
-
-func getBindingKey(bindingID string) string {
-	return fmt.Sprintf("bindings:%s", bindingID)
-}
-
-func (s *store) TestConnection() error {
-	return s.redisClient.Ping().Err()
+	return binding, err
 }